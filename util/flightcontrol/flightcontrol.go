@@ -1,10 +1,14 @@
 package flightcontrol
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"runtime"
+	"runtime/debug"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,15 +21,219 @@ import (
 
 var errRetry = errors.Errorf("retry")
 
-type Group struct {
-	mu sync.Mutex       // protects m
-	m  map[string]*call // lazily initialized
+// ErrGoexit is returned to waiters of a call whose fn invoked runtime.Goexit
+// instead of returning normally (e.g. through testing.T.FailNow in a test
+// helper called from fn).
+var ErrGoexit = errors.Errorf("flightcontrol: runtime.Goexit called in fn")
+
+// PanicError records a panic recovered from a call's fn so it can be
+// delivered to waiters as a regular error instead of crashing the goroutine
+// they never see.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
 }
 
-func (g *Group) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (v interface{}, err error) {
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("%v\n\n%s", p.Value, p.Stack)
+}
+
+func newPanicError(v interface{}) *PanicError {
+	stack := debug.Stack()
+	// The first line of the stack trace is of the form "goroutine N [status]:"
+	// but by the time the panic reaches a waiter the goroutine may no longer
+	// exist and its status will have changed. Trim out the misleading line.
+	if line := bytes.IndexByte(stack, '\n'); line >= 0 {
+		stack = stack[line+1:]
+	}
+	return &PanicError{Value: v, Stack: stack}
+}
+
+// EventType identifies a stage in a DoService call's lifecycle.
+type EventType int
+
+const (
+	EventStarted EventType = iota
+	EventWaiterAdded
+	EventWaiterRemoved
+	EventCancelled
+	EventFinished
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStarted:
+		return "started"
+	case EventWaiterAdded:
+		return "waiter-added"
+	case EventWaiterRemoved:
+		return "waiter-removed"
+	case EventCancelled:
+		return "cancelled"
+	case EventFinished:
+		return "finished"
+	default:
+		return "unknown"
+	}
+}
+
+// Event reports a lifecycle transition of a DoService call. Plain Do and
+// DoShared calls never emit events.
+type Event struct {
+	Type    EventType
+	Key     string
+	Name    string
+	Waiters int
+	Err     error
+}
+
+// ServiceInfo describes a currently in-flight DoService call.
+type ServiceInfo struct {
+	Key     string
+	Name    string
+	Waiters int
+	Started time.Time
+}
+
+// Result is returned by DoShared. Release must be called once the caller is
+// done with Value; the underlying fn's cleanup only runs after every caller
+// that was handed the same in-flight result has released it.
+type Result[V any] struct {
+	Value   V
+	Shared  bool
+	Refs    int
+	Release func()
+}
+
+// Handle exposes Start/Stop/Wait lifecycle for a single named DoService
+// call, so that currently deduplicated operations can be introspected and,
+// if stuck, force-cancelled from outside any one caller.
+type Handle interface {
+	Name() string
+	Done() <-chan struct{}
+	Err() error
+	Stop(ctx context.Context) error
+}
+
+// ReplayMode controls how much of a call's progress history a late-joining
+// waiter (one that attaches after some updates have already gone by) gets
+// replayed to it.
+type ReplayMode int
+
+const (
+	// ReplayLatestPerID replays only the most recent message for each ID,
+	// coalescing away intermediate updates. This is the default: it matches
+	// the unbounded map[string]*progress.Progress replay behavior this type
+	// replaces, bounded by evicting a whole ID once more than
+	// defaultReplayLimit IDs are retained. The ID evicted is the one first
+	// seen earliest, whether or not it is still receiving updates.
+	ReplayLatestPerID ReplayMode = iota
+	// ReplayFull replays the retained progress messages in arrival order,
+	// including intermediate updates for the same ID.
+	ReplayFull
+	// ReplayNone replays nothing; a late-joining waiter only sees updates
+	// from the point it joined onward.
+	ReplayNone
+)
+
+// GroupOption configures a Group or TypedGroup at construction time.
+type GroupOption func(*groupConfig)
+
+// WithProgressReplay sets how much progress history a Group or TypedGroup
+// replays to waiters that join a call already in progress. The default is
+// ReplayLatestPerID.
+func WithProgressReplay(mode ReplayMode) GroupOption {
+	return func(c *groupConfig) {
+		c.replayMode = mode
+	}
+}
+
+type groupConfig struct {
+	replayMode ReplayMode
+}
+
+// TypedGroup is a type-safe dedup group: fn for a given key runs at most
+// once concurrently, and every caller for that key gets back a V directly,
+// without boxing the result in interface{} and type-asserting it back out at
+// every dedup hit.
+type TypedGroup[K comparable, V any] struct {
+	mu          sync.Mutex    // protects m and subscribers
+	m           map[K]*call[V] // lazily initialized
+	subscribers []chan Event
+	cfg         groupConfig
+}
+
+// NewTypedGroup returns a TypedGroup configured with opts. The zero value
+// TypedGroup is also valid and behaves like NewTypedGroup() called with no
+// options.
+func NewTypedGroup[K comparable, V any](opts ...GroupOption) *TypedGroup[K, V] {
+	g := &TypedGroup[K, V]{}
+	for _, o := range opts {
+		o(&g.cfg)
+	}
+	return g
+}
+
+// Subscribe returns a channel of lifecycle events for every DoService call on
+// g, and a cancel func that must be called once the subscriber is done.
+// Events are dropped rather than blocking callers when the subscriber isn't
+// keeping up.
+func (g *TypedGroup[K, V]) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	g.mu.Lock()
+	g.subscribers = append(g.subscribers, ch)
+	g.mu.Unlock()
+
+	cancel := func() {
+		g.mu.Lock()
+		for i, s := range g.subscribers {
+			if s == ch {
+				g.subscribers = append(g.subscribers[:i], g.subscribers[i+1:]...)
+				break
+			}
+		}
+		g.mu.Unlock()
+		close(ch)
+	}
+	return ch, cancel
+}
+
+func (g *TypedGroup[K, V]) emit(ev Event) {
+	g.mu.Lock()
+	subs := append([]chan Event{}, g.subscribers...)
+	g.mu.Unlock()
+	for _, ch := range subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Services lists the DoService calls currently deduplicated by g, so an
+// admin endpoint can report active keys, waiter counts and elapsed time.
+func (g *TypedGroup[K, V]) Services() []ServiceInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]ServiceInfo, 0, len(g.m))
+	for _, c := range g.m {
+		if c.name == "" { // not a DoService call
+			continue
+		}
+		c.mu.Lock()
+		out = append(out, ServiceInfo{Key: c.key, Name: c.name, Waiters: len(c.ctxs), Started: c.started})
+		c.mu.Unlock()
+	}
+	return out
+}
+
+// Do executes fn for key, deduplicating concurrent calls for the same key.
+// The returned bool reports whether this caller was the leader that actually
+// invoked fn, as opposed to one that was handed an in-flight result.
+func (g *TypedGroup[K, V]) Do(ctx context.Context, key K, fn func(ctx context.Context) (V, error)) (V, bool, error) {
 	g.mu.Lock()
 	if g.m == nil {
-		g.m = make(map[string]*call)
+		g.m = make(map[K]*call[V])
 	}
 
 	if c, ok := g.m[key]; ok { // register 2nd waiter
@@ -35,10 +243,129 @@ func (g *Group) Do(ctx context.Context, key string, fn func(ctx context.Context)
 			runtime.Gosched()
 			return g.Do(ctx, key, fn)
 		}
+		return v, false, err
+	}
+
+	c := newCall(fn, g.cfg.replayMode)
+	c.key = fmt.Sprint(key)
+	g.m[key] = c
+	go func() {
+		// cleanup after a caller has returned
+		<-c.ready
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+	}()
+	g.mu.Unlock()
+	v, err := c.wait(ctx)
+	return v, true, err
+}
+
+// DoShared is like Do but the result is reference-counted: every caller that
+// receives it (the leader that ran fn and every deduped waiter) gets a
+// Release func, and cleanup is only invoked once the last of them has called
+// it. This lets fn hand back a resource (a snapshot ref, a mount, a pulled
+// blob) that needs to outlive any single caller for as long as other callers
+// are still using the deduped result.
+func (g *TypedGroup[K, V]) DoShared(ctx context.Context, key K, fn func(ctx context.Context) (V, error), cleanup func(v V)) (Result[V], error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[K]*call[V])
+	}
+
+	if c, ok := g.m[key]; ok { // register 2nd waiter
+		g.mu.Unlock()
+		res, err := c.waitShared(ctx, cleanup)
+		if err == errRetry {
+			runtime.Gosched()
+			return g.DoShared(ctx, key, fn, cleanup)
+		}
+		return res, err
+	}
+
+	c := newCall(fn, g.cfg.replayMode)
+	c.key = fmt.Sprint(key)
+	g.m[key] = c
+	go func() {
+		// cleanup after a caller has returned
+		<-c.ready
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+	}()
+	g.mu.Unlock()
+	return c.waitShared(ctx, cleanup)
+}
+
+// DoService is like Do but models the in-flight call as a nameable service:
+// it returns a Handle instead of blocking for the result, and g emits
+// started/waiter-added/waiter-removed/cancelled/finished events for it on
+// every channel returned by Subscribe.
+func (g *TypedGroup[K, V]) DoService(ctx context.Context, key K, name string, fn func(ctx context.Context) (V, error)) (Handle, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[K]*call[V])
+	}
+
+	waiterCtx, cancel := context.WithCancel(ctx)
+
+	if c, ok := g.m[key]; ok { // register 2nd waiter
+		g.mu.Unlock()
+		go c.wait(waiterCtx)
+		return &serviceHandle[V]{name: c.name, call: c, cancel: cancel}, nil
+	}
+
+	c := newCall(fn, g.cfg.replayMode)
+	c.key = fmt.Sprint(key)
+	c.name = name
+	c.emit = g.emit
+	g.m[key] = c
+	go func() {
+		// cleanup after a caller has returned
+		<-c.ready
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+	}()
+	g.mu.Unlock()
+
+	g.emit(Event{Type: EventStarted, Key: c.key, Name: name})
+	go c.wait(waiterCtx)
+
+	return &serviceHandle[V]{name: name, call: c, cancel: cancel}, nil
+}
+
+// DoWithBudget is like Do but enforces a per-call wall-clock budget
+// independent of any single waiter's ctx: once budget elapses since the
+// call started, c.ctx is cancelled with context.DeadlineExceeded so fn
+// observes cancellation (and every current and future waiter sees that
+// error) even if one of the waiters passed a ctx with no deadline at all.
+// budget <= 0 means no budget, equivalent to Do.
+//
+// The budget is owned by the call, not by the caller that happens to
+// request it: it keeps running for every waiter for as long as the call is
+// in flight, regardless of which caller's own ctx returns first. A caller
+// joining an already in-flight call also has its budget applied, tightening
+// the call's deadline if it is stricter than what's already armed.
+func (g *TypedGroup[K, V]) DoWithBudget(ctx context.Context, key K, budget time.Duration, fn func(ctx context.Context) (V, error)) (v V, err error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[K]*call[V])
+	}
+
+	if c, ok := g.m[key]; ok { // register 2nd waiter
+		g.mu.Unlock()
+		c.armBudget(budget)
+		v, err := c.wait(ctx)
+		if err == errRetry {
+			runtime.Gosched()
+			return g.DoWithBudget(ctx, key, budget, fn)
+		}
 		return v, err
 	}
 
-	c := newCall(fn)
+	c := newCall(fn, g.cfg.replayMode)
+	c.key = fmt.Sprint(key)
 	g.m[key] = c
 	go func() {
 		// cleanup after a caller has returned
@@ -48,29 +375,103 @@ func (g *Group) Do(ctx context.Context, key string, fn func(ctx context.Context)
 		g.mu.Unlock()
 	}()
 	g.mu.Unlock()
+
+	c.armBudget(budget)
+
 	return c.wait(ctx)
 }
 
-type call struct {
+// Group is the original interface{}-based dedup API, kept around for
+// backwards compatibility. It's a thin wrapper around
+// TypedGroup[string, interface{}]; callers that know their result type up
+// front should use TypedGroup directly instead, to avoid the interface{}
+// boxing and the type assertion that every dedup hit needs here.
+type Group struct {
+	tg TypedGroup[string, interface{}]
+}
+
+// NewGroup returns a Group configured with opts. The zero value Group is
+// also valid and behaves like NewGroup() called with no options.
+func NewGroup(opts ...GroupOption) *Group {
+	g := &Group{}
+	for _, o := range opts {
+		o(&g.tg.cfg)
+	}
+	return g
+}
+
+func (g *Group) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (v interface{}, err error) {
+	v, _, err = g.tg.Do(ctx, key, fn)
+	return v, err
+}
+
+func (g *Group) DoShared(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error), cleanup func(v interface{})) (Result[interface{}], error) {
+	return g.tg.DoShared(ctx, key, fn, cleanup)
+}
+
+func (g *Group) DoService(ctx context.Context, key, name string, fn func(ctx context.Context) (interface{}, error)) (Handle, error) {
+	return g.tg.DoService(ctx, key, name, fn)
+}
+
+func (g *Group) DoWithBudget(ctx context.Context, key string, budget time.Duration, fn func(ctx context.Context) (interface{}, error)) (v interface{}, err error) {
+	return g.tg.DoWithBudget(ctx, key, budget, fn)
+}
+
+func (g *Group) Subscribe() (<-chan Event, func()) {
+	return g.tg.Subscribe()
+}
+
+func (g *Group) Services() []ServiceInfo {
+	return g.tg.Services()
+}
+
+type call[V any] struct {
 	mu     sync.Mutex
-	result interface{}
+	result V
 	err    error
 	ready  chan struct{}
 
-	ctx  *sharedContext
+	ctx  *sharedContext[V]
 	ctxs []context.Context
-	fn   func(ctx context.Context) (interface{}, error)
+	fn   func(ctx context.Context) (V, error)
 	once sync.Once
 
 	closeProgressWriter func()
 	progressState       *progressState
+
+	// active refcount for DoShared callers; separate from ctxs, which tracks
+	// cancellation sources rather than how many callers still hold the result
+	refs    int
+	cleanup func(v V)
+
+	// key is set for every call; name and emit are only set for calls started
+	// through DoService. They let the call report its own lifecycle events
+	// and be listed by TypedGroup.Services.
+	key     string
+	name    string
+	emit    func(Event)
+	started time.Time
+
+	// budgetErr is set by TypedGroup.DoWithBudget's timer once the call's
+	// wall-clock budget has been exceeded, and takes over as c.err if fn
+	// returns without recording its own error.
+	budgetErr error
+
+	// budgetTimer and budgetDeadline back DoWithBudget. The timer is owned
+	// by the call rather than by whichever caller happened to arm it, so it
+	// keeps enforcing the budget for every waiter. It is only stopped once
+	// the call itself finishes (see run's cleanup), or when armBudget
+	// replaces it with a timer for a tighter deadline.
+	budgetTimer    *time.Timer
+	budgetDeadline time.Time
 }
 
-func newCall(fn func(ctx context.Context) (interface{}, error)) *call {
-	c := &call{
+func newCall[V any](fn func(ctx context.Context) (V, error), replayMode ReplayMode) *call[V] {
+	c := &call[V]{
 		fn:            fn,
 		ready:         make(chan struct{}),
-		progressState: newProgressState(),
+		progressState: newProgressState(replayMode),
+		started:       time.Now(),
 	}
 	ctx := newContext(c) // newSharedContext
 	pr, _, closeProgressWriter := progress.NewContext(ctx)
@@ -83,28 +484,126 @@ func newCall(fn func(ctx context.Context) (interface{}, error)) *call {
 	return c
 }
 
-func (c *call) run() {
-	defer c.closeProgressWriter()
-	v, err := c.fn(c.ctx)
+// armBudget ensures the call is force-cancelled no later than budget after
+// it started. It may be called by any caller of DoWithBudget for this call,
+// not just the one that created it, and tightens the deadline already armed
+// by an earlier caller rather than replacing it, so the strictest budget
+// requested by any waiter always wins. The timer it installs is owned by
+// the call and stopped once in run's cleanup, so it keeps running for the
+// full lifetime of the call regardless of which caller's context is done.
+func (c *call[V]) armBudget(budget time.Duration) {
+	if budget <= 0 {
+		return
+	}
+	deadline := c.started.Add(budget)
+
 	c.mu.Lock()
-	c.result = v
-	c.err = err
-	c.mu.Unlock()
-	close(c.ready)
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.ready:
+		return
+	default:
+	}
+
+	if c.budgetTimer != nil && !deadline.Before(c.budgetDeadline) {
+		return
+	}
+	if c.budgetTimer != nil {
+		c.budgetTimer.Stop()
+	}
+	c.budgetDeadline = deadline
+	c.budgetTimer = time.AfterFunc(time.Until(deadline), func() {
+		c.mu.Lock()
+		c.budgetErr = context.DeadlineExceeded
+		c.ctx.cancel(context.DeadlineExceeded)
+		c.mu.Unlock()
+	})
 }
 
-func (c *call) wait(ctx context.Context) (v interface{}, err error) {
+func (c *call[V]) run() {
+	defer c.closeProgressWriter()
+
+	normalReturn := false
+	recovered := false
+	defer func() {
+		// the given function invoked runtime.Goexit
+		if !normalReturn && !recovered {
+			c.mu.Lock()
+			c.err = ErrGoexit
+			c.mu.Unlock()
+		}
+
+		c.mu.Lock()
+		if c.err == nil && c.budgetErr != nil {
+			c.err = c.budgetErr
+		}
+		if c.budgetTimer != nil {
+			c.budgetTimer.Stop()
+		}
+		err := c.err
+		waiters := len(c.ctxs)
+		c.mu.Unlock()
+
+		close(c.ready)
+
+		if c.emit != nil {
+			c.emit(Event{Type: EventFinished, Key: c.key, Name: c.name, Err: err})
+		}
+
+		if pe, ok := err.(*PanicError); ok {
+			if waiters > 1 {
+				// more than one caller is waiting on this result; they have
+				// already been unblocked above with the error, but the panic
+				// must not be allowed to simply disappear into this goroutine
+				go panic(pe)
+			} else {
+				panic(pe)
+			}
+		}
+	}()
+
+	func() {
+		defer func() {
+			if !normalReturn {
+				if r := recover(); r != nil {
+					c.mu.Lock()
+					c.err = newPanicError(r)
+					c.mu.Unlock()
+					recovered = true
+				}
+			}
+		}()
+
+		v, err := c.fn(c.ctx)
+		c.mu.Lock()
+		c.result = v
+		c.err = err
+		c.mu.Unlock()
+		normalReturn = true
+	}()
+}
+
+func (c *call[V]) wait(ctx context.Context) (v V, err error) {
 	c.mu.Lock()
 	// detect case where caller has just returned, let it clean up before
 	select {
 	case <-c.ready: // could return if no error
 		c.mu.Unlock()
-		return nil, errRetry
+		var zero V
+		return zero, errRetry
 	default:
 	}
-	c.append(ctx)
+	waiters := c.append(ctx)
 	c.mu.Unlock()
 
+	// emitted with c.mu released: c.emit (TypedGroup.emit) takes g.mu, and
+	// other callers (e.g. Services) take g.mu then c.mu, so emitting while
+	// holding c.mu here would invert that lock order and can deadlock
+	if c.emit != nil {
+		c.emit(Event{Type: EventWaiterAdded, Key: c.key, Name: c.name, Waiters: waiters})
+	}
+
 	go c.once.Do(c.run)
 
 	select {
@@ -116,19 +615,93 @@ func (c *call) wait(ctx context.Context) (v interface{}, err error) {
 			<-c.ready
 			return c.result, c.err
 		default:
-			return nil, ctx.Err()
+			var zero V
+			return zero, ctx.Err()
+		}
+	case <-c.ready:
+		return c.result, c.err
+	}
+}
+
+// waitShared is the DoShared counterpart of wait: it additionally bumps the
+// call's refcount for a successful result and hands back a Release func that
+// only runs cleanup once every caller sharing this result has released it.
+func (c *call[V]) waitShared(ctx context.Context, cleanup func(v V)) (Result[V], error) {
+	c.mu.Lock()
+	select {
+	case <-c.ready: // could return if no error
+		c.mu.Unlock()
+		return Result[V]{}, errRetry
+	default:
+	}
+	if cleanup != nil && c.cleanup == nil {
+		c.cleanup = cleanup
+	}
+	waiters := c.append(ctx)
+	c.mu.Unlock()
+
+	// see wait: must emit without c.mu held, to avoid inverting the lock
+	// order against TypedGroup.emit/Services (g.mu then c.mu)
+	if c.emit != nil {
+		c.emit(Event{Type: EventWaiterAdded, Key: c.key, Name: c.name, Waiters: waiters})
+	}
+
+	go c.once.Do(c.run)
+
+	select {
+	case <-ctx.Done():
+		select {
+		case <-c.ctx.Done():
+			// if this cancelled the last context, then wait for function to shut down
+			// and don't accept any more callers
+			<-c.ready
+		default:
+			return Result[V]{}, ctx.Err()
 		}
 	case <-c.ready:
-		return c.result, c.err // shared not implemented yet
 	}
+
+	c.mu.Lock()
+	err := c.err
+	v := c.result
+	if err == nil {
+		c.refs++
+	}
+	refs := c.refs
+	c.mu.Unlock()
+
+	if err != nil {
+		return Result[V]{}, err
+	}
+
+	var releaseOnce sync.Once
+	release := func() {
+		releaseOnce.Do(func() {
+			c.mu.Lock()
+			c.refs--
+			refs := c.refs
+			cleanup := c.cleanup
+			result := c.result
+			c.mu.Unlock()
+			if refs == 0 && cleanup != nil {
+				cleanup(result)
+			}
+		})
+	}
+
+	return Result[V]{Value: v, Shared: refs > 1, Refs: refs, Release: release}, nil
 }
 
-func (c *call) append(ctx context.Context) {
+// append registers ctx as a waiter. Called with c.mu held; returns the new
+// waiter count so the caller can emit EventWaiterAdded itself once it has
+// released c.mu (see wait/waitShared).
+func (c *call[V]) append(ctx context.Context) (waiters int) {
 	pw, ok, ctx := progress.FromContext(ctx)
 	if ok {
 		c.progressState.add(pw)
 	}
 	c.ctxs = append(c.ctxs, ctx)
+	waiters = len(c.ctxs)
 	go func() {
 		select {
 		case <-c.ctx.done:
@@ -136,34 +709,49 @@ func (c *call) append(ctx context.Context) {
 			c.mu.Lock()
 			c.ctx.signal()
 			c.mu.Unlock()
+			if c.emit != nil {
+				c.emit(Event{Type: EventWaiterRemoved, Key: c.key, Name: c.name})
+			}
 		}
 	}()
+	return waiters
 }
 
-func (c *call) Deadline() (deadline time.Time, ok bool) {
+// Deadline returns the *latest* deadline among the still-live waiters, i.e.
+// as long as the most patient caller allows fn to keep running. A live
+// waiter with no deadline at all means fn must be allowed to run unbounded,
+// so that takes priority over any waiter's concrete deadline.
+func (c *call[V]) Deadline() (deadline time.Time, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	var max time.Time
+	var found bool
 	for _, ctx := range c.ctxs {
 		select {
 		case <-ctx.Done():
+			continue
 		default:
-			dl, ok := ctx.Deadline()
-			if ok {
-				return dl, ok
-			}
+		}
+		dl, ok := ctx.Deadline()
+		if !ok {
+			return time.Time{}, false
+		}
+		if !found || dl.After(max) {
+			max = dl
+			found = true
 		}
 	}
-	return time.Time{}, false
+	return max, found
 }
 
-func (c *call) Done() <-chan struct{} {
+func (c *call[V]) Done() <-chan struct{} {
 	c.mu.Lock()
 	c.ctx.signal()
 	c.mu.Unlock()
 	return c.ctx.done
 }
 
-func (c *call) Err() error {
+func (c *call[V]) Err() error {
 	select {
 	case <-c.ctx.Done():
 		return c.ctx.err
@@ -172,7 +760,7 @@ func (c *call) Err() error {
 	}
 }
 
-func (c *call) Value(key interface{}) interface{} {
+func (c *call[V]) Value(key interface{}) interface{} {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	for _, ctx := range append([]context.Context{}, c.ctxs...) {
@@ -187,18 +775,55 @@ func (c *call) Value(key interface{}) interface{} {
 	return nil
 }
 
-type sharedContext struct {
-	*call
+type serviceHandle[V any] struct {
+	name   string
+	call   *call[V]
+	cancel context.CancelFunc
+}
+
+func (h *serviceHandle[V]) Name() string          { return h.name }
+func (h *serviceHandle[V]) Done() <-chan struct{} { return h.call.ready }
+
+func (h *serviceHandle[V]) Err() error {
+	h.call.mu.Lock()
+	defer h.call.mu.Unlock()
+	return h.call.err
+}
+
+func (h *serviceHandle[V]) Stop(ctx context.Context) error {
+	if h.call.emit != nil {
+		h.call.emit(Event{Type: EventCancelled, Key: h.call.key, Name: h.name})
+	}
+	h.cancel()
+	// cancel fn's context for every waiter, not just this handle's own
+	h.call.mu.Lock()
+	h.call.ctx.cancel(context.Canceled)
+	h.call.mu.Unlock()
+	select {
+	case <-h.call.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type sharedContext[V any] struct {
+	*call[V]
 	done chan struct{}
 	err  error
 }
 
-func newContext(c *call) *sharedContext {
-	return &sharedContext{call: c, done: make(chan struct{})}
+func newContext[V any](c *call[V]) *sharedContext[V] {
+	return &sharedContext[V]{call: c, done: make(chan struct{})}
 }
 
+// signal is called whenever a waiter's context is cancelled, including the
+// waiter with the shortest deadline. It only actually closes c.done once
+// every waiter is done, i.e. once that cancellation removed the last active
+// context - a waiter with a later deadline keeps fn running regardless of
+// how early a shorter-lived waiter expired.
 // call with lock
-func (c *sharedContext) signal() {
+func (c *sharedContext[V]) signal() {
 	select {
 	case <-c.done:
 	default:
@@ -216,22 +841,100 @@ func (c *sharedContext) signal() {
 	}
 }
 
+// cancel forces c.done closed with err regardless of whether every waiter
+// has cancelled. It's used by TypedGroup.DoWithBudget to cut off fn once a
+// call's wall-clock budget is exceeded, independent of any single waiter's
+// own deadline.
+// call with lock
+func (c *sharedContext[V]) cancel(err error) {
+	select {
+	case <-c.done:
+	default:
+		c.err = err
+		close(c.done)
+	}
+}
+
 type rawProgressWriter interface {
 	WriteRawProgress(*progress.Progress) error
 	Close() error
 }
 
+// defaultReplayLimit bounds how many progress messages a progressState
+// retains for replay to a late-joining waiter, regardless of ReplayMode. For
+// a long build, items previously grew for as long as the build kept
+// introducing new progress IDs; this caps it.
+const defaultReplayLimit = 1000
+
 type progressState struct {
-	mu      sync.Mutex
-	items   map[string]*progress.Progress
-	writers []rawProgressWriter
+	mu     sync.Mutex
+	mode   ReplayMode
+	ring   []*progress.Progress          // arrival-order buffer, used by ReplayFull
+	latest map[string]*progress.Progress // coalesced per-ID state, used by ReplayLatestPerID
+	order  []string                      // id arrival order, parallels latest
+
+	writers []*progressWriter
 	done    bool
 }
 
-func newProgressState() *progressState {
-	return &progressState{
-		items: make(map[string]*progress.Progress),
+func newProgressState(mode ReplayMode) *progressState {
+	ps := &progressState{mode: mode}
+	if mode == ReplayLatestPerID {
+		ps.latest = make(map[string]*progress.Progress)
 	}
+	return ps
+}
+
+// record stores p according to ps.mode, bounded to defaultReplayLimit.
+// Called with ps.mu held.
+func (ps *progressState) record(p *progress.Progress) {
+	switch ps.mode {
+	case ReplayNone:
+		return
+	case ReplayLatestPerID:
+		if existing, ok := ps.latest[p.ID]; ok {
+			if p.Timestamp.Before(existing.Timestamp) {
+				// stale, out-of-order update: don't regress what a late
+				// joiner would be replayed
+				return
+			}
+		} else {
+			ps.order = append(ps.order, p.ID)
+			if len(ps.order) > defaultReplayLimit {
+				drop := ps.order[0]
+				ps.order = ps.order[1:]
+				delete(ps.latest, drop)
+			}
+		}
+		ps.latest[p.ID] = p
+	default: // ReplayFull
+		ps.ring = append(ps.ring, p)
+		if len(ps.ring) > defaultReplayLimit {
+			ps.ring = ps.ring[1:]
+		}
+	}
+}
+
+// replaySnapshot returns what a newly joining writer should be replayed,
+// oldest first. Called with ps.mu held.
+func (ps *progressState) replaySnapshot() []*progress.Progress {
+	var out []*progress.Progress
+	switch ps.mode {
+	case ReplayNone:
+		return nil
+	case ReplayLatestPerID:
+		out = make([]*progress.Progress, 0, len(ps.latest))
+		for _, p := range ps.latest {
+			out = append(out, p)
+		}
+		sort.Slice(out, func(i, j int) bool {
+			return out[i].Timestamp.Before(out[j].Timestamp)
+		})
+	default:
+		// ring is already in arrival order
+		out = append([]*progress.Progress{}, ps.ring...)
+	}
+	return out
 }
 
 func (ps *progressState) run(pr progress.Reader) {
@@ -241,21 +944,25 @@ func (ps *progressState) run(pr progress.Reader) {
 			if err == io.EOF {
 				ps.mu.Lock()
 				ps.done = true
+				writers := append([]*progressWriter{}, ps.writers...)
 				ps.mu.Unlock()
-				for _, w := range ps.writers {
-					w.Close()
+				for _, w := range writers {
+					w.close()
 				}
 			}
 			return
 		}
 		ps.mu.Lock()
-		for _, p := range p {
-			for _, w := range ps.writers {
-				w.WriteRawProgress(p)
-			}
-			ps.items[p.ID] = p
+		for _, pp := range p {
+			ps.record(pp)
 		}
+		writers := append([]*progressWriter{}, ps.writers...)
 		ps.mu.Unlock()
+		for _, w := range writers {
+			for _, pp := range p {
+				w.write(pp)
+			}
+		}
 	}
 }
 
@@ -264,21 +971,83 @@ func (ps *progressState) add(pw progress.Writer) {
 	if !ok {
 		return
 	}
+	w := newProgressWriter(rw)
+
 	ps.mu.Lock()
-	plist := make([]*progress.Progress, 0, len(ps.items))
-	for _, p := range ps.items {
-		plist = append(plist, p)
+	plist := ps.replaySnapshot()
+	done := ps.done
+	if !done {
+		ps.writers = append(ps.writers, w)
 	}
-	sort.Slice(plist, func(i, j int) bool {
-		return plist[i].Timestamp.Before(plist[j].Timestamp)
-	})
+	ps.mu.Unlock()
+
 	for _, p := range plist {
-		rw.WriteRawProgress(p)
+		w.write(p)
 	}
-	if ps.done {
-		rw.Close()
-	} else {
-		ps.writers = append(ps.writers, rw)
+	if done {
+		w.close()
 	}
-	ps.mu.Unlock()
+}
+
+// progressWriterBuffer bounds how many pending messages a slow
+// rawProgressWriter can have queued before further messages are dropped
+// instead of piling up.
+const progressWriterBuffer = 256
+
+// progressWriter decouples a rawProgressWriter from progressState's reader
+// goroutine. WriteRawProgress used to be called directly while holding
+// ps.mu, so one slow writer blocked delivery to every other waiter. Writes
+// are now handed to a buffered channel drained by a dedicated goroutine; if
+// that channel is full, the message is dropped and counted, and the count is
+// surfaced to the writer as a synthetic progress.Progress once it catches up.
+type progressWriter struct {
+	rw      rawProgressWriter
+	ch      chan *progress.Progress
+	dropped uint64 // accessed via atomic
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newProgressWriter(rw rawProgressWriter) *progressWriter {
+	w := &progressWriter{
+		rw:   rw,
+		ch:   make(chan *progress.Progress, progressWriterBuffer),
+		done: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *progressWriter) run() {
+	defer close(w.done)
+	var reported uint64
+	for p := range w.ch {
+		if dropped := atomic.LoadUint64(&w.dropped); dropped != reported {
+			reported = dropped
+			w.rw.WriteRawProgress(&progress.Progress{
+				ID:        fmt.Sprintf("flightcontrol-dropped-progress:%d", dropped),
+				Timestamp: p.Timestamp,
+			})
+		}
+		if err := w.rw.WriteRawProgress(p); err != nil {
+			return
+		}
+	}
+}
+
+func (w *progressWriter) write(p *progress.Progress) {
+	select {
+	case w.ch <- p:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+func (w *progressWriter) close() {
+	w.closeOnce.Do(func() {
+		close(w.ch)
+	})
+	<-w.done
+	w.rw.Close()
 }
@@ -0,0 +1,347 @@
+package flightcontrol
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tonistiigi/buildkit_poc/util/progress"
+	"golang.org/x/net/context"
+)
+
+func TestDoDetectsRuntimeGoexit(t *testing.T) {
+	g := NewGroup()
+
+	_, err := g.Do(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+		runtime.Goexit()
+		return nil, nil
+	})
+	if err != ErrGoexit {
+		t.Fatalf("expected ErrGoexit, got %v", err)
+	}
+}
+
+func TestPanicErrorWrapsRecoveredValue(t *testing.T) {
+	pe := newPanicError("boom")
+
+	if !strings.Contains(pe.Error(), "boom") {
+		t.Fatalf("expected recovered value in error message, got %q", pe.Error())
+	}
+	if !strings.Contains(pe.Error(), ".go:") {
+		t.Fatalf("expected a stack dump in error message, got %q", pe.Error())
+	}
+}
+
+func TestDoSharedReleasesOnlyAfterLastRef(t *testing.T) {
+	g := NewGroup()
+
+	started := make(chan struct{})
+	var startOnce sync.Once
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		startOnce.Do(func() { close(started) })
+		<-release
+		return "v", nil
+	}
+
+	var cleanups int32
+	cleanup := func(v interface{}) { atomic.AddInt32(&cleanups, 1) }
+
+	var wg sync.WaitGroup
+	results := make([]Result[interface{}], 2)
+	errs := make([]error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = g.DoShared(context.Background(), "key", fn, cleanup)
+		}(i)
+	}
+
+	<-started
+	// give the second caller time to join the in-flight call before it
+	// completes, so both share one result
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("caller %d: unexpected error %v", i, err)
+		}
+		if results[i].Value != "v" {
+			t.Fatalf("caller %d: unexpected value %v", i, results[i].Value)
+		}
+	}
+
+	results[0].Release()
+	if got := atomic.LoadInt32(&cleanups); got != 0 {
+		t.Fatalf("cleanup ran before the last ref was released")
+	}
+
+	results[1].Release()
+	if got := atomic.LoadInt32(&cleanups); got != 1 {
+		t.Fatalf("expected cleanup to run exactly once after the last release, ran %d times", got)
+	}
+}
+
+func TestDoServiceEmitsLifecycleEvents(t *testing.T) {
+	g := NewGroup()
+	ch, cancel := g.Subscribe()
+	defer cancel()
+
+	release := make(chan struct{})
+	h, err := g.DoService(context.Background(), "key", "svc", func(ctx context.Context) (interface{}, error) {
+		<-release
+		return "v", nil
+	})
+	if err != nil {
+		t.Fatalf("DoService: %v", err)
+	}
+
+	if ev := <-ch; ev.Type != EventStarted || ev.Name != "svc" {
+		t.Fatalf("expected started event for svc, got %+v", ev)
+	}
+
+	close(release)
+	<-h.Done()
+
+	// DoService's own internal waiter also goes through append, so a
+	// waiter-added event may be interleaved before the finished event.
+	for {
+		ev := <-ch
+		if ev.Type == EventFinished {
+			break
+		}
+		if ev.Type != EventWaiterAdded {
+			t.Fatalf("expected waiter-added or finished event, got %+v", ev)
+		}
+	}
+}
+
+// TestDoServiceConcurrentWaitersAndServices joins more waiters onto an
+// in-flight DoService call while hammering Services() from another
+// goroutine. Services() locks g.mu then the call's mu; a waiter joining
+// used to emit EventWaiterAdded while still holding the call's mu, which
+// locks g.mu in the opposite order and deadlocks under exactly this kind of
+// contention.
+func TestDoServiceConcurrentWaitersAndServices(t *testing.T) {
+	g := NewGroup()
+
+	started := make(chan struct{})
+	var startOnce sync.Once
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		startOnce.Do(func() { close(started) })
+		<-release
+		return "v", nil
+	}
+
+	h, err := g.DoService(context.Background(), "key", "svc", fn)
+	if err != nil {
+		t.Fatalf("DoService: %v", err)
+	}
+	<-started
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				g.Services()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hh, err := g.DoService(context.Background(), "key", "svc", fn)
+			if err != nil {
+				t.Errorf("DoService: %v", err)
+				return
+			}
+			<-hh.Done()
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(stop)
+
+	<-h.Done()
+	if err := h.Err(); err != nil {
+		t.Fatalf("unexpected service error: %v", err)
+	}
+}
+
+// TestDoWithBudgetEnforcedForAllWaiters mirrors a leader whose own ctx
+// expires well before the call's budget, joined by a follower with no
+// deadline of its own. The budget must still cut the follower off: it must
+// not inherit whatever's left of the leader's stack-scoped timer.
+func TestDoWithBudgetEnforcedForAllWaiters(t *testing.T) {
+	g := NewGroup()
+
+	const budget = 100 * time.Millisecond
+
+	leaderCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	started := make(chan struct{})
+	var startOnce sync.Once
+	fn := func(ctx context.Context) (interface{}, error) {
+		startOnce.Do(func() { close(started) })
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	go g.DoWithBudget(leaderCtx, "key", budget, fn)
+	<-started
+
+	start := time.Now()
+	_, err := g.DoWithBudget(context.Background(), "key", budget, fn)
+	elapsed := time.Since(start)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed > budget*5 {
+		t.Fatalf("follower wasn't cut off by the call's budget, took %s", elapsed)
+	}
+}
+
+func TestTypedGroupDeduplicatesConcurrentCallers(t *testing.T) {
+	g := NewTypedGroup[int, string]()
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "v", nil
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	results := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _, err := g.Do(context.Background(), 1, fn)
+			results[i] = v
+			errs[i] = err
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected fn to run once for deduplicated callers, ran %d times", got)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("caller %d: unexpected error %v", i, err)
+		}
+		if results[i] != "v" {
+			t.Fatalf("caller %d: unexpected result %q", i, results[i])
+		}
+	}
+}
+
+func TestProgressStateBoundsReplayFull(t *testing.T) {
+	ps := newProgressState(ReplayFull)
+
+	ps.mu.Lock()
+	for i := 0; i < defaultReplayLimit+50; i++ {
+		ps.record(&progress.Progress{ID: fmt.Sprintf("id-%d", i), Timestamp: time.Now()})
+	}
+	snap := ps.replaySnapshot()
+	ps.mu.Unlock()
+
+	if len(snap) != defaultReplayLimit {
+		t.Fatalf("expected replay to be capped at %d entries, got %d", defaultReplayLimit, len(snap))
+	}
+	if snap[0].ID != "id-50" {
+		t.Fatalf("expected the oldest 50 entries to have been dropped, first ID is %q", snap[0].ID)
+	}
+}
+
+func TestProgressStateCoalescesLatestPerID(t *testing.T) {
+	ps := newProgressState(ReplayLatestPerID)
+
+	base := time.Now()
+	ps.mu.Lock()
+	ps.record(&progress.Progress{ID: "a", Timestamp: base})
+	ps.record(&progress.Progress{ID: "a", Timestamp: base.Add(time.Second)})
+	ps.record(&progress.Progress{ID: "b", Timestamp: base})
+	snap := ps.replaySnapshot()
+	ps.mu.Unlock()
+
+	if len(snap) != 2 {
+		t.Fatalf("expected one coalesced entry per ID, got %d entries", len(snap))
+	}
+	for _, p := range snap {
+		if p.ID == "a" && !p.Timestamp.Equal(base.Add(time.Second)) {
+			t.Fatalf("expected id %q to be replayed with its latest update, got timestamp %v", p.ID, p.Timestamp)
+		}
+	}
+}
+
+type fakeRawProgressWriter struct {
+	mu      sync.Mutex
+	written []*progress.Progress
+	block   chan struct{}
+}
+
+func (f *fakeRawProgressWriter) WriteRawProgress(p *progress.Progress) error {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mu.Lock()
+	f.written = append(f.written, p)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeRawProgressWriter) Close() error { return nil }
+
+// TestProgressWriterDropsInsteadOfBlockingOnSlowWriter exercises the
+// decoupling between progressState's reader goroutine and a single slow
+// rawProgressWriter: WriteRawProgress used to be called synchronously, so
+// one stuck writer blocked delivery to every other waiter. write() must stay
+// non-blocking and start dropping once the writer's buffer fills.
+func TestProgressWriterDropsInsteadOfBlockingOnSlowWriter(t *testing.T) {
+	block := make(chan struct{})
+	rw := &fakeRawProgressWriter{block: block}
+	w := newProgressWriter(rw)
+
+	for i := 0; i < progressWriterBuffer+10; i++ {
+		w.write(&progress.Progress{ID: fmt.Sprintf("id-%d", i), Timestamp: time.Now()})
+	}
+
+	if got := atomic.LoadUint64(&w.dropped); got == 0 {
+		t.Fatalf("expected writes past the buffer to be dropped while the writer was stuck")
+	}
+
+	close(block)
+	w.close()
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if len(rw.written) == 0 {
+		t.Fatalf("expected the writer to flush its buffered progress once unblocked")
+	}
+}